@@ -0,0 +1,98 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cluster tells a tgres process which peer owns a given DS,
+// so data points for DSes owned elsewhere can be forwarded instead
+// of cached locally. Static exposes a fixed, operator-supplied peer
+// list; it is meant to be the first of several Cluster
+// implementations, with etcd/serf-backed membership plugging in
+// later behind the same interface.
+package cluster
+
+import (
+	"sort"
+
+	"github.com/awesomegolang/tgres/hashring"
+)
+
+// Cluster reports DS ownership across a set of tgres peers.
+type Cluster interface {
+	// Owner returns the address of the peer that owns the DS named
+	// name, or "" if this process owns it. name must be the stable
+	// DS name, not a node-local DS id: ids are assigned independently
+	// on each peer (a DB sequence), so hashing on one would have
+	// every peer disagree about who owns a given metric.
+	Owner(name string) string
+	// Self is this process's own peer address.
+	Self() string
+	// Peers is the full set of peer addresses, including Self().
+	Peers() []string
+}
+
+// Static is a Cluster backed by a fixed peer list known up front
+// (e.g. from config), with ownership assigned by a consistent-hash
+// ring over the peers rather than by DS id modulo peer count, so a
+// membership change only moves the DSes that actually changed
+// owner.
+type Static struct {
+	self  string
+	peers []string
+	ring  *hashring.Ring
+}
+
+// NewStatic builds a Static cluster. self must appear in peers.
+func NewStatic(self string, peers []string) *Static {
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted) // deterministic vnode assignment across all peers' processes
+	return &Static{self: self, peers: sorted, ring: hashring.New(len(sorted), 0)}
+}
+
+func (c *Static) ownerPeer(name string) string {
+	return c.peers[c.ring.GetString(name)]
+}
+
+// Owner implements Cluster.
+func (c *Static) Owner(name string) string {
+	if owner := c.ownerPeer(name); owner != c.self {
+		return owner
+	}
+	return ""
+}
+
+// Self implements Cluster.
+func (c *Static) Self() string { return c.self }
+
+// Peers implements Cluster.
+func (c *Static) Peers() []string { return c.peers }
+
+// Reshard reports, for a membership change from this cluster's
+// current peer list to newPeers, which of names actually changed
+// owner. Only those need to be flushed and re-cached by the caller.
+// Ring members are positions in the sorted peer list: a new peer
+// that sorts after every existing one takes over only its own share
+// of names and everything else stays where it was, but a peer added
+// or removed anywhere else shifts the positions of the peers sorted
+// after it, and their names move as well.
+func (c *Static) Reshard(newPeers []string, names []string) []string {
+	next := NewStatic(c.self, newPeers)
+
+	var moved []string
+	for _, name := range names {
+		if c.ownerPeer(name) != next.ownerPeer(name) {
+			moved = append(moved, name)
+		}
+	}
+	return moved
+}
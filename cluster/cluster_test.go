@@ -0,0 +1,61 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOwnerReturnsEmptyForSelf(t *testing.T) {
+	c := NewStatic("a", []string{"a", "b", "c"})
+	for _, name := range []string{"metric.1", "metric.2", "metric.3", "metric.4"} {
+		if owner := c.Owner(name); owner == "a" {
+			t.Fatalf("Owner(%q) returned self (%q) instead of \"\"", name, owner)
+		}
+	}
+}
+
+func TestReshardOnlyMovesNamesThatChangedOwner(t *testing.T) {
+	c := NewStatic("a", []string{"a", "b", "c"})
+
+	names := make([]string, 500)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric.%d", i)
+	}
+
+	moved := c.Reshard([]string{"a", "b", "c", "d"}, names)
+
+	moves := make(map[string]bool, len(moved))
+	for _, name := range moved {
+		moves[name] = true
+	}
+
+	next := NewStatic("a", []string{"a", "b", "c", "d"})
+	for _, name := range names {
+		changed := c.ownerPeer(name) != next.ownerPeer(name)
+		if changed != moves[name] {
+			t.Fatalf("Reshard disagreed with ownerPeer for %q: changed=%v, in moved=%v", name, changed, moves[name])
+		}
+	}
+
+	if len(moved) == 0 {
+		t.Fatalf("Reshard reported no moved names, expected some rebalancing onto the new peer")
+	}
+	if len(moved) == len(names) {
+		t.Fatalf("Reshard moved every name, expected only a fraction to change owner")
+	}
+}
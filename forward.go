@@ -0,0 +1,115 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timeriver
+
+import (
+	"encoding/gob"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// forwardedDataPoint is what crosses the wire between tgres cluster
+// peers - just enough of a trDataPoint to re-queue it on the owning
+// peer, without dragging the (already-resolved, peer-local) *ds
+// pointer along.
+type forwardedDataPoint struct {
+	Name      string
+	TimeStamp time.Time
+	Value     float64
+}
+
+// forwarder is the first, simplest implementation of tgres's
+// internal cluster protocol: one persistent TCP connection per
+// peer, gob-encoded. It exists so dispatchOne has somewhere to send
+// a trDataPoint for a DS this process doesn't own; a future
+// revision can swap this for gRPC without the dispatcher noticing.
+type forwarder struct {
+	mu    sync.Mutex
+	conns map[string]*gob.Encoder
+}
+
+func newForwarder() *forwarder {
+	return &forwarder{conns: make(map[string]*gob.Encoder)}
+}
+
+func (f *forwarder) forward(peer string, dp *trDataPoint) error {
+	enc, err := f.encoderFor(peer)
+	if err != nil {
+		return err
+	}
+
+	fdp := forwardedDataPoint{Name: dp.Name, TimeStamp: dp.TimeStamp, Value: dp.Value}
+	if err := enc.Encode(&fdp); err != nil {
+		f.mu.Lock()
+		delete(f.conns, peer)
+		f.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (f *forwarder) encoderFor(peer string) (*gob.Encoder, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if enc, ok := f.conns[peer]; ok {
+		return enc, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", peer, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	enc := gob.NewEncoder(conn)
+	f.conns[peer] = enc
+	return enc, nil
+}
+
+// listenForForwardedDataPoints accepts forwarded data points from
+// other tgres cluster peers and feeds them into the normal
+// queueDataPoint/dispatcher path, exactly as if they had arrived
+// over StatsD/Graphite/Prometheus locally.
+func listenForForwardedDataPoints(t *trTransceiver, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("listenForForwardedDataPoints(): net.Listen(%s) error: %v", addr, err)
+		return
+	}
+	log.Printf("listenForForwardedDataPoints(): accepting peer forwards on %s", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("listenForForwardedDataPoints(): Accept() error: %v", err)
+			continue
+		}
+		go receiveForwardedDataPoints(t, conn)
+	}
+}
+
+func receiveForwardedDataPoints(t *trTransceiver, conn net.Conn) {
+	defer conn.Close()
+	dec := gob.NewDecoder(conn)
+	for {
+		var fdp forwardedDataPoint
+		if err := dec.Decode(&fdp); err != nil {
+			return
+		}
+		t.queueDataPoint(&trDataPoint{Name: fdp.Name, TimeStamp: fdp.TimeStamp, Value: fdp.Value})
+	}
+}
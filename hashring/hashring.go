@@ -0,0 +1,90 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hashring implements a consistent-hash ring keyed by either
+// an int64 id or a string (a DS's node-local id or its stable name,
+// in tgres's case - use whichever is actually agreed upon by
+// whoever is comparing Get results). Unlike `id % n`, adding or
+// removing a member only moves the fraction of keys that member
+// actually owns instead of reshuffling the whole keyspace, which
+// matters both when config.Workers changes and when tgres nodes
+// join or leave a cluster.
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// defaultVnodes is a reasonable default number of virtual nodes per
+// member: enough that load is distributed evenly across members
+// without the sorted vnode slice growing unreasonably large.
+const defaultVnodes = 150
+
+type vnode struct {
+	hash   uint32
+	member int
+}
+
+// Ring maps int64 keys onto a fixed set of members via consistent
+// hashing.
+type Ring struct {
+	vnodes []vnode
+}
+
+// New builds a Ring over numMembers (identified by their index, 0
+// to numMembers-1), each given vnodesPerMember virtual nodes on the
+// ring. Pass 0 for vnodesPerMember to get the default of 150.
+func New(numMembers, vnodesPerMember int) *Ring {
+	if vnodesPerMember <= 0 {
+		vnodesPerMember = defaultVnodes
+	}
+
+	r := &Ring{vnodes: make([]vnode, 0, numMembers*vnodesPerMember)}
+	for m := 0; m < numMembers; m++ {
+		for v := 0; v < vnodesPerMember; v++ {
+			r.vnodes = append(r.vnodes, vnode{hash: hash(strconv.Itoa(m) + "#" + strconv.Itoa(v)), member: m})
+		}
+	}
+	sort.Slice(r.vnodes, func(i, j int) bool { return r.vnodes[i].hash < r.vnodes[j].hash })
+	return r
+}
+
+// Get returns the index (0 to numMembers-1) of the member that owns
+// key.
+func (r *Ring) Get(key int64) int {
+	return r.GetString(strconv.FormatInt(key, 10))
+}
+
+// GetString returns the index (0 to numMembers-1) of the member
+// that owns key. Use this (rather than Get) for any key that needs
+// to hash the same way across processes, such as a DS name in
+// cluster mode - a node-local id would hash consistently only on
+// the node that assigned it.
+func (r *Ring) GetString(key string) int {
+	h := hash(key)
+	i := sort.Search(len(r.vnodes), func(i int) bool { return r.vnodes[i].hash >= h })
+	if i == len(r.vnodes) {
+		i = 0
+	}
+	return r.vnodes[i].member
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
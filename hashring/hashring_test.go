@@ -0,0 +1,61 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingGetStringStable(t *testing.T) {
+	r := New(4, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("metric.%d", i)
+		first := r.GetString(key)
+		if got := r.GetString(key); got != first {
+			t.Fatalf("GetString(%q) not stable across calls: %d then %d", key, first, got)
+		}
+	}
+}
+
+func TestRingGetAddingMemberMovesOnlyAFraction(t *testing.T) {
+	const numKeys = 2000
+
+	before := New(4, 0)
+	after := New(5, 0)
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("metric.%d", i)
+	}
+
+	var moved int
+	for _, key := range keys {
+		if before.GetString(key) != after.GetString(key) {
+			moved++
+		}
+	}
+
+	// Adding a 5th member to 4 should move roughly 1/5 of the
+	// keyspace, not reshuffle everything the way `hash(key) % n`
+	// would.
+	if moved > numKeys/2 {
+		t.Fatalf("adding a member moved %d/%d keys, expected well under half", moved, numKeys)
+	}
+	if moved == 0 {
+		t.Fatalf("adding a member moved no keys at all, expected some rebalancing")
+	}
+}
@@ -0,0 +1,162 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timeriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// promExporter is a subsystem alongside serviceMgr: it exposes all
+// currently-cached DSes and RRAs as Prometheus text exposition on
+// /metrics, and accepts Prometheus remote_write protobuf posts on
+// /receive, turning each sample into a trDataPoint fed into the
+// normal dispatcher path. This lets tgres act as both a
+// Graphite/StatsD sink and a Prometheus scrape/remote-write target
+// without a sidecar.
+type promExporter struct {
+	t      *trTransceiver
+	server *http.Server
+}
+
+func newPromExporter(t *trTransceiver) *promExporter {
+	mux := http.NewServeMux()
+	pe := &promExporter{
+		t:      t,
+		server: &http.Server{Addr: config.PrometheusListenSpec, Handler: mux},
+	}
+	mux.HandleFunc("/metrics", pe.serveMetrics)
+	mux.HandleFunc("/receive", pe.serveRemoteWrite)
+	return pe
+}
+
+func (pe *promExporter) start() {
+	if config.PrometheusListenSpec == "" {
+		return
+	}
+	log.Printf("promExporter: listening on %s", config.PrometheusListenSpec)
+	if err := pe.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("promExporter: ListenAndServe() error: %v", err)
+	}
+}
+
+func (pe *promExporter) stop() {
+	if config.PrometheusListenSpec == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pe.server.Shutdown(ctx)
+}
+
+// serveMetrics walks the DS cache through requestDsCopy, the same
+// path the HTTP API already uses, so exposition never contends with
+// the workers for a DS's live state.
+func (pe *promExporter) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, id := range pe.t.dss.ids() {
+		ds := pe.t.requestDsCopy(id)
+		if ds == nil {
+			continue
+		}
+		name := promMetricName(ds.Name)
+		for _, rra := range ds.RRAs {
+			ts, val := rra.Latest()
+			if ts.IsZero() {
+				continue
+			}
+			fmt.Fprintf(w, "%s{step=\"%s\"} %v %d\n", name, rra.Step(), val, ts.Unix()*1000)
+		}
+	}
+
+	pe.writeInternalCounters(w)
+}
+
+// writeInternalCounters exports receiver-internal counters so tgres
+// operators can alert on backpressure without scraping logs.
+func (pe *promExporter) writeInternalCounters(w http.ResponseWriter) {
+	for i, ch := range pe.t.workerChs {
+		fmt.Fprintf(w, "tgres_worker_queue_depth{worker=\"%d\"} %d\n", i, len(ch))
+	}
+	fmt.Fprintf(w, "tgres_dispatcher_drops_total %d\n", atomic.LoadInt64(&pe.t.dispatcherDrops))
+	for i := range pe.t.flusherLatency {
+		fmt.Fprintf(w, "tgres_flusher_latency_seconds{flusher=\"%d\"} %v\n", i, time.Duration(atomic.LoadInt64(&pe.t.flusherLatency[i])).Seconds())
+	}
+}
+
+// serveRemoteWrite accepts a Prometheus remote_write request and
+// feeds each sample into queueDataPoint, the same entry point
+// statsd/graphite data points use.
+func (pe *promExporter) serveRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		name := promSeriesName(ts.Labels)
+		if name == "" {
+			continue
+		}
+		for _, s := range ts.Samples {
+			pe.t.queueDataPoint(&trDataPoint{
+				Name:      name,
+				TimeStamp: time.Unix(0, s.Timestamp*int64(time.Millisecond)),
+				Value:     s.Value,
+			})
+		}
+	}
+}
+
+// promMetricName maps a DS name to a Prometheus-legal metric name.
+func promMetricName(dsName string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(dsName)
+}
+
+// promSeriesName maps a remote_write label set's __name__ label
+// back into a tgres DS name.
+func promSeriesName(labels []prompb.Label) string {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+	return ""
+}
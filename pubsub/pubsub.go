@@ -0,0 +1,278 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubsub lets HTTP/WebSocket clients subscribe to a
+// filtered live stream of data points as they pass through the
+// dispatcher - a `tail -f` for metrics without polling the RRAs.
+// Publish never blocks ingest: every subscriber has a bounded
+// buffer, and a slow subscriber just has points dropped off the
+// back (and counted), never stalls the publisher.
+package pubsub
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Op is the comparison operator of a Condition.
+type Op int
+
+const (
+	Eq Op = iota
+	NotEq
+	Regex
+	LessThan
+	GreaterThan
+	Exists
+)
+
+// ParseOp maps the query language's operator spelling onto an Op.
+func ParseOp(s string) (Op, bool) {
+	switch s {
+	case "=":
+		return Eq, true
+	case "!=":
+		return NotEq, true
+	case "=~":
+		return Regex, true
+	case "<":
+		return LessThan, true
+	case ">":
+		return GreaterThan, true
+	case "EXISTS":
+		return Exists, true
+	}
+	return 0, false
+}
+
+// Condition is one clause of a Query: Key (either "name" or a tag
+// key) Op Value. A Query is the AND of its Conditions. Build one
+// with NewCondition, not a struct literal: for Op == Regex that's
+// what compiles Value and catches a malformed pattern up front.
+type Condition struct {
+	Key   string
+	Op    Op
+	Value string
+
+	re *regexp.Regexp // compiled by NewCondition, only set when Op == Regex
+}
+
+// NewCondition builds a Condition, compiling value up front if op is
+// Regex. Compiling here - rather than lazily on first match, which
+// would run on whatever goroutine is calling Publish - turns a
+// malformed pattern into an error the caller can reject (e.g. with a
+// 400) instead of a panic on the shared dispatch path.
+func NewCondition(key string, op Op, value string) (Condition, error) {
+	c := Condition{Key: key, Op: op, Value: value}
+	if op == Regex {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return Condition{}, fmt.Errorf("invalid regex %q: %v", value, err)
+		}
+		c.re = re
+	}
+	return c, nil
+}
+
+func (c *Condition) matches(dp DataPoint) bool {
+	actual, ok := c.lookup(dp)
+
+	if c.Op == Exists {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+
+	switch c.Op {
+	case Eq:
+		return actual == c.Value
+	case NotEq:
+		return actual != c.Value
+	case Regex:
+		if c.re == nil {
+			// Only reachable via a Condition{} struct literal built
+			// outside NewCondition; treat it as a non-match rather
+			// than panicking the caller's goroutine.
+			return false
+		}
+		return c.re.MatchString(actual)
+	case LessThan, GreaterThan:
+		af, aerr := strconv.ParseFloat(actual, 64)
+		vf, verr := strconv.ParseFloat(c.Value, 64)
+		if aerr != nil || verr != nil {
+			return false
+		}
+		if c.Op == LessThan {
+			return af < vf
+		}
+		return af > vf
+	}
+	return false
+}
+
+func (c *Condition) lookup(dp DataPoint) (string, bool) {
+	if c.Key == "name" {
+		return dp.DpName(), true
+	}
+	v, ok := dp.DpTags()[c.Key]
+	return v, ok
+}
+
+// DataPoint is the minimal view of a data point a Query needs. It
+// lets pubsub stay independent of tgres's internal trDataPoint
+// representation.
+type DataPoint interface {
+	DpName() string
+	DpTags() map[string]string
+}
+
+// Query matches data points against a set of AND-ed Conditions.
+type Query interface {
+	Matches(dp DataPoint) bool
+	Conditions() []Condition
+}
+
+type andQuery struct {
+	conditions []Condition
+}
+
+// New builds a Query that matches a DataPoint satisfying every one
+// of conditions (an empty Query matches everything).
+func New(conditions ...Condition) Query {
+	return &andQuery{conditions: conditions}
+}
+
+func (q *andQuery) Conditions() []Condition { return q.conditions }
+
+func (q *andQuery) Matches(dp DataPoint) bool {
+	for i := range q.conditions {
+		if !q.conditions[i].matches(dp) {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriberBufferSize bounds how far behind a subscriber can fall
+// before Publish starts dropping points for it.
+const subscriberBufferSize = 64
+
+// Subscription is a live, filtered view onto a Hub's stream.
+// Publish never blocks on it: once its buffer is full, further
+// matching points are dropped and counted in Drops instead.
+type Subscription struct {
+	query Query
+	ch    chan DataPoint
+	Drops int64 // atomic
+
+	name    string // exact name filter, if query.Conditions() has one
+	indexed bool
+}
+
+// Chan is where matching data points arrive.
+func (s *Subscription) Chan() <-chan DataPoint { return s.ch }
+
+// Hub fans published data points out to every matching
+// Subscription. Subscriptions with an exact Condition{Key: "name",
+// Op: Eq} are indexed by name so Publish doesn't have to run every
+// other subscriber's (possibly regex) Conditions against a point
+// that can't match them anyway.
+type Hub struct {
+	mu        sync.RWMutex
+	byName    map[string][]*Subscription
+	unindexed []*Subscription
+}
+
+// NewHub creates an empty Hub.
+func NewHub() *Hub {
+	return &Hub{byName: make(map[string][]*Subscription)}
+}
+
+// Subscribe registers a new Subscription matching query. The caller
+// must call Unsubscribe when done with it.
+func (h *Hub) Subscribe(query Query) *Subscription {
+	sub := &Subscription{query: query, ch: make(chan DataPoint, subscriberBufferSize)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if name, ok := exactNameFilter(query); ok {
+		sub.name, sub.indexed = name, true
+		h.byName[name] = append(h.byName[name], sub)
+	} else {
+		h.unindexed = append(h.unindexed, sub)
+	}
+	return sub
+}
+
+// Unsubscribe removes sub from the Hub.
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sub.indexed {
+		h.byName[sub.name] = removeSub(h.byName[sub.name], sub)
+	} else {
+		h.unindexed = removeSub(h.unindexed, sub)
+	}
+}
+
+func removeSub(subs []*Subscription, target *Subscription) []*Subscription {
+	for i, s := range subs {
+		if s == target {
+			return append(subs[:i], subs[i+1:]...)
+		}
+	}
+	return subs
+}
+
+// Publish fans dp out to every Subscription whose Query matches it.
+// It never blocks: a Subscription whose buffer is full has this
+// point dropped instead.
+func (h *Hub) Publish(dp DataPoint) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, sub := range h.byName[dp.DpName()] {
+		publishTo(sub, dp)
+	}
+	for _, sub := range h.unindexed {
+		if sub.query.Matches(dp) {
+			publishTo(sub, dp)
+		}
+	}
+}
+
+func publishTo(sub *Subscription, dp DataPoint) {
+	if !sub.query.Matches(dp) {
+		return
+	}
+	select {
+	case sub.ch <- dp:
+	default:
+		atomic.AddInt64(&sub.Drops, 1)
+	}
+}
+
+func exactNameFilter(q Query) (string, bool) {
+	for _, c := range q.Conditions() {
+		if c.Key == "name" && c.Op == Eq {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
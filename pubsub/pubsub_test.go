@@ -0,0 +1,100 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import "testing"
+
+type testPoint struct {
+	name string
+	tags map[string]string
+}
+
+func (p testPoint) DpName() string            { return p.name }
+func (p testPoint) DpTags() map[string]string { return p.tags }
+
+func TestExactNameFilterMatchesEqCondition(t *testing.T) {
+	c, err := NewCondition("name", Eq, "app.requests")
+	if err != nil {
+		t.Fatalf("NewCondition: %v", err)
+	}
+	name, ok := exactNameFilter(New(c))
+	if !ok || name != "app.requests" {
+		t.Fatalf("exactNameFilter = (%q, %v), want (%q, true)", name, ok, "app.requests")
+	}
+}
+
+func TestExactNameFilterIgnoresNonEqOrNonNameConditions(t *testing.T) {
+	regexCond, err := NewCondition("name", Regex, "^app\\.")
+	if err != nil {
+		t.Fatalf("NewCondition: %v", err)
+	}
+	if _, ok := exactNameFilter(New(regexCond)); ok {
+		t.Fatalf("exactNameFilter indexed a Regex condition on name")
+	}
+
+	tagCond, err := NewCondition("host", Eq, "web1")
+	if err != nil {
+		t.Fatalf("NewCondition: %v", err)
+	}
+	if _, ok := exactNameFilter(New(tagCond)); ok {
+		t.Fatalf("exactNameFilter indexed an Eq condition on a non-name key")
+	}
+}
+
+func TestHubPublishUsesNameIndexAndUnindexedFallback(t *testing.T) {
+	h := NewHub()
+
+	nameCond, err := NewCondition("name", Eq, "app.requests")
+	if err != nil {
+		t.Fatalf("NewCondition: %v", err)
+	}
+	indexedSub := h.Subscribe(New(nameCond))
+	defer h.Unsubscribe(indexedSub)
+
+	hostCond, err := NewCondition("host", Eq, "web1")
+	if err != nil {
+		t.Fatalf("NewCondition: %v", err)
+	}
+	unindexedSub := h.Subscribe(New(hostCond))
+	defer h.Unsubscribe(unindexedSub)
+
+	h.Publish(testPoint{name: "app.requests", tags: map[string]string{"host": "web1"}})
+
+	select {
+	case <-indexedSub.Chan():
+	default:
+		t.Fatalf("indexed subscription did not receive a matching point")
+	}
+	select {
+	case <-unindexedSub.Chan():
+	default:
+		t.Fatalf("unindexed subscription did not receive a matching point")
+	}
+
+	h.Publish(testPoint{name: "app.errors", tags: map[string]string{"host": "web1"}})
+
+	select {
+	case <-indexedSub.Chan():
+		t.Fatalf("indexed subscription received a point for a different name")
+	default:
+	}
+}
+
+func TestNewConditionRejectsInvalidRegex(t *testing.T) {
+	if _, err := NewCondition("name", Regex, "["); err == nil {
+		t.Fatalf("NewCondition accepted a malformed regex")
+	}
+}
@@ -17,19 +17,10 @@ package receiver
 
 import (
 	"log"
-	"math/rand"
 	"time"
-)
 
-var workerPeriodicFlushSignal = func(periodicFlushCheck chan bool, minCacheDur, maxCacheDur time.Duration) {
-	for {
-		// Sleep randomly between min and max cache durations (is this wise?)
-		i := int(maxCacheDur.Nanoseconds()-minCacheDur.Nanoseconds()) / 1000000
-		dur := time.Duration(rand.Intn(i+1))*time.Millisecond + minCacheDur
-		time.Sleep(dur)
-		periodicFlushCheck <- true
-	}
-}
+	"github.com/awesomegolang/tgres/ticker"
+)
 
 var workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[int64]bool, dss *dsCache, minCacheDur, maxCacheDur time.Duration, maxPoints int) {
 	for dsId, _ := range recent {
@@ -49,21 +40,24 @@ var workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[i
 	}
 }
 
-var worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incomingDpWithDs, dss *dsCache, minCacheDur, maxCacheDur time.Duration, maxPoints int) {
+// worker's periodic flush check used to be driven by a goroutine
+// that slept a random duration and could neither be stopped nor
+// faked in tests; tk now supplies that signal, defaulting to
+// ticker.NewRandomizedTicker(minCacheDur, maxCacheDur) in
+// production, so tests can hand it a ticker.LogicalTicker instead.
+var worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incomingDpWithDs, dss *dsCache, tk ticker.Ticker, minCacheDur, maxCacheDur time.Duration, maxPoints int) {
 	wc.onEnter()
 	defer wc.onExit()
+	defer tk.Stop()
 
 	recent := make(map[int64]bool)
 
-	periodicFlushCheck := make(chan bool)
-	go workerPeriodicFlushSignal(periodicFlushCheck, minCacheDur, maxCacheDur)
-
 	log.Printf("  - %s started.", wc.ident())
 	wc.onStarted()
 
 	for {
 		select {
-		case <-periodicFlushCheck:
+		case <-tk.Chan():
 			workerPeriodicFlush(wc.ident(), dsf, recent, dss, minCacheDur, maxCacheDur, maxPoints)
 		case dpds, ok := <-workerCh:
 			if !ok {
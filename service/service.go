@@ -0,0 +1,133 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package service defines a small lifecycle framework used to
+// replace the ad-hoc start/stop/WaitGroup bookkeeping that used to
+// be hand-rolled in every long-running goroutine in tgres. A
+// Service can only be started once and stopped once, ordering
+// mistakes return a typed error instead of silently no-op-ing, and
+// shutdown is driven by context cancellation rather than a
+// sentinel-closed channel or a busy-poll loop.
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrAlreadyStarted is returned by Start if the service is already
+// running.
+var ErrAlreadyStarted = errors.New("service: already started")
+
+// ErrAlreadyStopped is returned by Stop if the service has already
+// been stopped.
+var ErrAlreadyStopped = errors.New("service: already stopped")
+
+// ErrNotStarted is returned by Stop if the service was never
+// started.
+var ErrNotStarted = errors.New("service: not started")
+
+// Service is anything with a start/stop lifecycle that can be
+// composed under a parent and waited on for a clean shutdown.
+type Service interface {
+	Start(ctx context.Context) error
+	Stop() error
+	Wait()
+	IsRunning() bool
+	String() string
+}
+
+// BaseService implements the state machine common to every Service
+// in tgres: a service starts exactly once, stops exactly once, and
+// Wait() blocks until its goroutine has actually returned. Build one
+// with NewBaseService, giving it the function that does the actual
+// work; that function receives a context that is cancelled by Stop.
+type BaseService struct {
+	name string
+	fn   func(context.Context)
+
+	mu      sync.Mutex
+	started bool
+	running bool
+	cancel  context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+var _ Service = (*BaseService)(nil)
+
+// NewBaseService creates a BaseService identified by name (used for
+// logging and String()) that runs fn when Start is called.
+func NewBaseService(name string, fn func(context.Context)) *BaseService {
+	return &BaseService{name: name, fn: fn}
+}
+
+func (b *BaseService) String() string { return b.name }
+
+// Start implements Service: it transitions the service to running
+// and launches fn in its own goroutine with a context derived from
+// ctx. It returns ErrAlreadyStarted if called more than once.
+func (b *BaseService) Start(ctx context.Context) error {
+	b.mu.Lock()
+	if b.started {
+		b.mu.Unlock()
+		return ErrAlreadyStarted
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	b.started, b.running, b.cancel = true, true, cancel
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.setStopped()
+		b.fn(runCtx)
+	}()
+	return nil
+}
+
+func (b *BaseService) setStopped() {
+	b.mu.Lock()
+	b.running = false
+	b.mu.Unlock()
+}
+
+// Stop implements Service. It cancels the context passed to fn. It
+// does not block until fn returns - call Wait() for that.
+func (b *BaseService) Stop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.started {
+		return ErrNotStarted
+	}
+	if !b.running || b.cancel == nil {
+		return ErrAlreadyStopped
+	}
+	b.cancel()
+	b.cancel = nil
+	return nil
+}
+
+// Wait implements Service. It blocks until fn has returned.
+func (b *BaseService) Wait() { b.wg.Wait() }
+
+// IsRunning implements Service. It reports whether fn is still
+// executing.
+func (b *BaseService) IsRunning() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running
+}
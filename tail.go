@@ -0,0 +1,142 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timeriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/awesomegolang/tgres/pubsub"
+)
+
+// DpName implements pubsub.DataPoint.
+func (dp *trDataPoint) DpName() string { return dp.Name }
+
+// DpTags implements pubsub.DataPoint. This tree doesn't model DS
+// tags yet, so there's nothing to look up - conditions on a tag key
+// simply never match, which is the same as "no tags".
+func (dp *trDataPoint) DpTags() map[string]string { return nil }
+
+// tailServer is a subsystem alongside serviceMgr and promExporter:
+// it lets operators subscribe to a filtered live stream of
+// trDataPoints as they pass through the dispatcher - a `tail -f`
+// for metrics without polling the RRAs.
+type tailServer struct {
+	t      *trTransceiver
+	server *http.Server
+}
+
+func newTailServer(t *trTransceiver) *tailServer {
+	mux := http.NewServeMux()
+	ts := &tailServer{
+		t:      t,
+		server: &http.Server{Addr: config.TailListenSpec, Handler: mux},
+	}
+	mux.HandleFunc("/tail", ts.serveTail)
+	return ts
+}
+
+func (ts *tailServer) start() {
+	if config.TailListenSpec == "" {
+		return
+	}
+	log.Printf("tailServer: listening on %s", config.TailListenSpec)
+	if err := ts.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("tailServer: ListenAndServe() error: %v", err)
+	}
+}
+
+func (ts *tailServer) stop() {
+	if config.TailListenSpec == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ts.server.Shutdown(ctx)
+}
+
+// serveTail streams every trDataPoint matching the query encoded in
+// the request as newline-delimited JSON, for as long as the client
+// stays connected. A browser client would more naturally hold this
+// open over a WebSocket, but the pubsub.Hub/Query plumbing
+// underneath is exactly the same either way - this is the plain
+// HTTP version of it.
+func (ts *tailServer) serveTail(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTailQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := ts.t.pubsub.Subscribe(query)
+	defer ts.t.pubsub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case dp := <-sub.Chan():
+			if err := enc.Encode(dp); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// parseTailQuery turns one or more repeated ?cond=key,op[,value]
+// query params into a pubsub.Query. key is "name" or a tag key; op
+// is one of =, !=, =~, <, >, EXISTS. Conditions are AND-ed.
+//
+//	/tail?cond=name,=~,^app\.&cond=host,=,web1
+func parseTailQuery(values url.Values) (pubsub.Query, error) {
+	var conditions []pubsub.Condition
+	for _, raw := range values["cond"] {
+		parts := strings.SplitN(raw, ",", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("malformed cond %q, want key,op[,value]", raw)
+		}
+		op, ok := pubsub.ParseOp(parts[1])
+		if !ok {
+			return nil, fmt.Errorf("unknown operator %q in cond %q", parts[1], raw)
+		}
+		var value string
+		if len(parts) == 3 {
+			value = parts[2]
+		}
+		c, err := pubsub.NewCondition(parts[0], op, value)
+		if err != nil {
+			return nil, fmt.Errorf("bad cond %q: %v", raw, err)
+		}
+		conditions = append(conditions, c)
+	}
+	return pubsub.New(conditions...), nil
+}
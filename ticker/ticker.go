@@ -0,0 +1,152 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ticker abstracts the periodic "it's time to check/flush"
+// signal used by the workers and the stat flusher. Production code
+// gets a real, jittered or wall-clock-aligned timer; tests get a
+// logical clock they advance themselves, so flush-boundary behavior
+// can be exercised without a real sleep and without flaking when
+// the system clock is adjusted mid-test.
+package ticker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Ticker is anything that periodically delivers the current time on
+// a channel, until Stop is called.
+type Ticker interface {
+	// Chan returns the channel ticks are delivered on.
+	Chan() <-chan time.Time
+	// Stop releases the ticker's resources. It does not close Chan().
+	Stop()
+}
+
+// randomizedTicker fires after a duration chosen uniformly at
+// random between min and max, and reschedules itself after every
+// fire. This reproduces tgres's original worker flush-check
+// behavior and is the Ticker used in production.
+type randomizedTicker struct {
+	min, max time.Duration
+	ch       chan time.Time
+	stopCh   chan struct{}
+}
+
+// NewRandomizedTicker returns a Ticker that fires at a random
+// interval in [min, max), forever, until Stop is called.
+func NewRandomizedTicker(min, max time.Duration) Ticker {
+	t := &randomizedTicker{min: min, max: max, ch: make(chan time.Time), stopCh: make(chan struct{})}
+	go t.run()
+	return t
+}
+
+func (t *randomizedTicker) run() {
+	for {
+		span := int64(t.max - t.min)
+		dur := t.min
+		if span > 0 {
+			dur += time.Duration(rand.Int63n(span))
+		}
+		select {
+		case <-time.After(dur):
+			select {
+			case t.ch <- time.Now():
+			case <-t.stopCh:
+				return
+			}
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *randomizedTicker) Chan() <-chan time.Time { return t.ch }
+func (t *randomizedTicker) Stop()                  { close(t.stopCh) }
+
+// alignedTicker fires as close as possible to every multiple of
+// interval (e.g. every :00/:10/:20 for a 10s interval). It
+// recomputes the sleep duration on every iteration instead of
+// accumulating drift the way a plain time.Ticker would, so it stays
+// aligned even if the system clock is adjusted. This is the
+// production Ticker behind the stat worker's flush alignment.
+type alignedTicker struct {
+	interval time.Duration
+	ch       chan time.Time
+	stopCh   chan struct{}
+}
+
+// NewAlignedTicker returns a Ticker that fires at every wall-clock
+// multiple of interval, forever, until Stop is called.
+func NewAlignedTicker(interval time.Duration) Ticker {
+	t := &alignedTicker{interval: interval, ch: make(chan time.Time), stopCh: make(chan struct{})}
+	go t.run()
+	return t
+}
+
+func (t *alignedTicker) run() {
+	for {
+		now := time.Now()
+		wait := now.Truncate(t.interval).Add(t.interval).Sub(now)
+		select {
+		case <-time.After(wait):
+			select {
+			case t.ch <- time.Now():
+			case <-t.stopCh:
+				return
+			}
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *alignedTicker) Chan() <-chan time.Time { return t.ch }
+func (t *alignedTicker) Stop()                  { close(t.stopCh) }
+
+// LogicalTicker is a Ticker driven by a virtual clock that a test
+// advances directly via Advance, rather than a real-time timer. It
+// fires once for every interval boundary Advance crosses, so a test
+// can walk time across several flush boundaries deterministically
+// and without sleeping.
+type LogicalTicker struct {
+	interval time.Duration
+	now      time.Time
+	ch       chan time.Time
+}
+
+// NewLogicalTicker returns a LogicalTicker starting at start that
+// fires every interval of virtual time.
+func NewLogicalTicker(start time.Time, interval time.Duration) *LogicalTicker {
+	return &LogicalTicker{interval: interval, now: start, ch: make(chan time.Time)}
+}
+
+// Advance moves the virtual clock forward by d, firing once on Chan
+// for every interval boundary crossed. Unlike a real Ticker, which
+// drops a tick its consumer isn't ready for, Advance blocks on each
+// send - crossing N boundaries always delivers N ticks, which is the
+// entire point of a ticker a test can walk across several flush
+// boundaries and assert on every one.
+func (lt *LogicalTicker) Advance(d time.Duration) {
+	end := lt.now.Add(d)
+	for !lt.now.Add(lt.interval).After(end) {
+		lt.now = lt.now.Add(lt.interval)
+		lt.ch <- lt.now
+	}
+	lt.now = end
+}
+
+func (lt *LogicalTicker) Chan() <-chan time.Time { return lt.ch }
+func (lt *LogicalTicker) Stop()                  {}
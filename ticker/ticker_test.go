@@ -0,0 +1,63 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ticker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogicalTickerAdvanceDeliversOneTickPerBoundary(t *testing.T) {
+	start := time.Unix(0, 0)
+	lt := NewLogicalTicker(start, 10*time.Second)
+
+	go lt.Advance(35 * time.Second)
+
+	want := []time.Time{
+		start.Add(10 * time.Second),
+		start.Add(20 * time.Second),
+		start.Add(30 * time.Second),
+	}
+	for i, w := range want {
+		select {
+		case got := <-lt.Chan():
+			if !got.Equal(w) {
+				t.Fatalf("tick %d: got %v, want %v", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("tick %d: timed out waiting for tick %v", i, w)
+		}
+	}
+
+	select {
+	case got := <-lt.Chan():
+		t.Fatalf("unexpected extra tick: %v", got)
+	default:
+	}
+}
+
+func TestLogicalTickerAdvanceWithinBoundaryFiresNoTick(t *testing.T) {
+	start := time.Unix(0, 0)
+	lt := NewLogicalTicker(start, 10*time.Second)
+
+	lt.Advance(5 * time.Second)
+
+	select {
+	case got := <-lt.Chan():
+		t.Fatalf("unexpected tick before a boundary was crossed: %v", got)
+	default:
+	}
+}
@@ -16,29 +16,46 @@
 package timeriver
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/awesomegolang/tgres/cluster"
+	"github.com/awesomegolang/tgres/hashring"
+	"github.com/awesomegolang/tgres/pubsub"
+	"github.com/awesomegolang/tgres/service"
+	"github.com/awesomegolang/tgres/ticker"
+	"github.com/beorn7/perks/quantile"
 )
 
 type trTransceiver struct {
-	serviceMgr   *trServiceManager
-	dss          *trDataSources
-	dpCh         chan *trDataPoint     // incoming data point
-	workerChs    []chan *trDataPoint   // incoming data point with ds
-	flusherChs   []chan *trDataSource  // ds to flush
-	dsCopyChs    []chan *dsCopyRequest // request a copy of a DS (used by HTTP)
-	stCh         chan *trStat          // incoming statd stats
-	workerWg     sync.WaitGroup
-	flusherWg    sync.WaitGroup
-	statWg       sync.WaitGroup
-	dispatcherWg sync.WaitGroup
-	startWg      sync.WaitGroup
+	serviceMgr      *trServiceManager
+	promExporter    *promExporter
+	tailServer      *tailServer
+	pubsub          *pubsub.Hub
+	dss             *trDataSources
+	dpCh            chan *trDataPoint     // incoming data point
+	workerChs       []chan *trDataPoint   // incoming data point with ds
+	flusherChs      []chan *trDataSource  // ds to flush
+	dsCopyChs       []chan *dsCopyRequest // request a copy of a DS (used by HTTP)
+	stCh            chan *trStat          // incoming statd stats
+	dispatcherSvc   service.Service
+	workerSvcs      []service.Service
+	flusherSvcs     []service.Service
+	statSvc         service.Service
+	startWg         sync.WaitGroup
+	dispatcherDrops int64   // atomic: data points dropped by the dispatcher (no matching/creatable DS)
+	flusherLatency  []int64 // atomic: nanoseconds the last flush took, per flusher id
+	ring            *hashring.Ring // maps a DS id onto a worker/flusher/dsCopy index
+	cluster         cluster.Cluster
+	forwarder       *forwarder
 }
 
 type dsCopyRequest struct {
@@ -49,15 +66,26 @@ type dsCopyRequest struct {
 func newTransceiver() *trTransceiver {
 	dss := &trDataSources{}
 	return &trTransceiver{dss: dss,
-		dpCh: make(chan *trDataPoint, 1048576), // so we can survive a graceful restart
+		dpCh:   make(chan *trDataPoint, 1048576), // so we can survive a graceful restart
+		pubsub: pubsub.NewHub(),
 	}
 }
 
 func (t *trTransceiver) start(gracefulProtos string) error {
-	t.startWorkers()
-	t.startFlushers()
-	t.startStatWorker()
+	if len(config.ClusterPeers) > 0 {
+		t.cluster = cluster.NewStatic(config.ClusterSelf, config.ClusterPeers)
+		t.forwarder = newForwarder()
+		go listenForForwardedDataPoints(t, config.ClusterSelf)
+	}
+
+	t.startWorkers(context.Background())
+	t.startFlushers(context.Background())
+	t.startStatWorker(context.Background())
 	t.serviceMgr = newServiceManager(t)
+	t.promExporter = newPromExporter(t)
+	go t.promExporter.start()
+	t.tailServer = newTailServer(t)
+	go t.tailServer.start()
 
 	if err := t.serviceMgr.run(gracefulProtos); err != nil {
 		return err
@@ -80,106 +108,134 @@ func (t *trTransceiver) start(gracefulProtos string) error {
 
 	t.dss.reload() // *finally* load the data (because graceful restart)
 
-	go t.dispatcher() // now start dispatcher
+	t.dispatcherSvc = service.NewBaseService("dispatcher", t.dispatcher)
+	t.dispatcherSvc.Start(context.Background()) // now start dispatcher
 
 	return nil
 }
 
 func (t *trTransceiver) stop() {
 
+	t.promExporter.stop()
+	t.tailServer.stop()
 	t.serviceMgr.closeListeners()
 	log.Printf("Waiting for all TCP connections to finish...")
 	tcpWg.Wait()
 	log.Printf("TCP connections finished.")
 
+	// Stop the stat worker - and let it emit its final flush - while
+	// dpCh is still open and the dispatcher/workers/flushers are
+	// still running. Its flush re-enqueues synthetic data points via
+	// queueDataPoint(), which sends on dpCh; if dpCh were already
+	// closed, or the workers it ultimately lands on already stopped,
+	// that final flush would panic or vanish instead of landing in
+	// storage.
+	t.stopStatWorker()
+
 	log.Printf("Closing dispatcher channel...")
 	close(t.dpCh)
-	t.dispatcherWg.Wait()
+	t.dispatcherSvc.Wait()
 	log.Printf("Dispatcher finished.")
 
 }
 
+// stopWorkers and stopFlushers are called by the dispatcher, in that
+// order, once it sees dpCh closed - by then the stat worker has
+// already stopped and flushed (see stop()), so nothing is still
+// producing data points for them to miss. Stop() only cancels each
+// Service's context - it's up to the Service itself to drain
+// whatever is already buffered in its channel before Wait() unblocks,
+// so there is no busy-poll here waiting for channels to "look empty"
+// the way there used to be.
 func (t *trTransceiver) stopWorkers() {
-	log.Printf("stopWorkers(): waiting for worker channels to empty...")
-	empty := false
-	for !empty {
-		empty = true
-		for _, c := range t.workerChs {
-			if len(c) > 0 {
-				empty = false
-				break
-			}
-		}
-		if !empty {
-			time.Sleep(100 * time.Millisecond)
-		}
+	log.Printf("stopWorkers(): stopping all workers...")
+	for _, w := range t.workerSvcs {
+		w.Stop()
 	}
-
-	log.Printf("stopWorkers(): closing all worker channels...")
-	for _, ch := range t.workerChs {
-		close(ch)
+	for _, w := range t.workerSvcs {
+		w.Wait()
 	}
-	log.Printf("stopWorkers(): waiting for workers to finish...")
-	t.workerWg.Wait()
 	log.Printf("stopWorkers(): all workers finished.")
 }
 
 func (t *trTransceiver) stopFlushers() {
-	log.Printf("stopFlushers(): closing all flusher channels...")
-	for _, ch := range t.flusherChs {
-		close(ch)
+	log.Printf("stopFlushers(): stopping all flushers...")
+	for _, f := range t.flusherSvcs {
+		f.Stop()
+	}
+	for _, f := range t.flusherSvcs {
+		f.Wait()
 	}
-	log.Printf("stopFlushers(): waiting for flushers to finish...")
-	t.flusherWg.Wait()
 	log.Printf("stopFlushers(): all flushers finished.")
 }
 
 func (t *trTransceiver) stopStatWorker() {
-
-	log.Printf("stopStatWorker(): waiting for stat channel to empty...")
-	for len(t.stCh) > 0 {
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	log.Printf("stopStatWorker(): closing stat channel...")
-	close(t.stCh)
-	log.Printf("stopStatWorker(): waiting for stat worker to finish...")
-	t.statWg.Wait()
+	log.Printf("stopStatWorker(): stopping stat worker...")
+	t.statSvc.Stop()
+	t.statSvc.Wait()
 	log.Printf("stopStatWorker(): stat worker finished.")
 }
 
-func (t *trTransceiver) dispatcher() {
-	t.dispatcherWg.Add(1)
-	defer t.dispatcherWg.Done()
-
+func (t *trTransceiver) dispatcher(ctx context.Context) {
 	for {
-		dp, ok := <-t.dpCh
-
-		if !ok {
-			log.Printf("dispatcher(): channel closed, shutting down")
-			t.stopStatWorker()
-			t.stopWorkers()
-			t.stopFlushers()
-			break
+		select {
+		case <-ctx.Done():
+			return
+		case dp, ok := <-t.dpCh:
+			if !ok {
+				log.Printf("dispatcher(): channel closed, shutting down")
+				t.stopWorkers()
+				t.stopFlushers()
+				return
+			}
+			t.dispatchOne(dp)
 		}
+	}
+}
 
-		if dp.ds = t.dss.getByName(dp.Name); dp.ds == nil {
-			// DS does not exist, can we create it?
-			if dsSpec := config.findMatchingDsSpec(dp.Name); dsSpec != nil {
-				if ds, err := createDataSource(dp.Name, dsSpec); err == nil {
-					t.dss.insert(ds)
-					dp.ds = ds
-				} else {
-					log.Printf("dispatcher(): createDataSource() error: %v", err)
-					continue
-				}
+func (t *trTransceiver) dispatchOne(dp *trDataPoint) {
+	// Ownership is keyed on the DS name, not a DS id: ids are
+	// assigned locally (a DB sequence), so the same metric name has
+	// a different id on every peer and hashing on id would have
+	// each node disagree about who owns it - a point forwarded to
+	// the "owner" would just get forwarded again. The name is the
+	// one thing every peer agrees on.
+	if t.cluster != nil {
+		if owner := t.cluster.Owner(dp.Name); owner != "" {
+			if err := t.forwarder.forward(owner, dp); err != nil {
+				log.Printf("dispatcher(): forwarding %q to %s failed: %v", dp.Name, owner, err)
+				atomic.AddInt64(&t.dispatcherDrops, 1)
 			}
+			return
 		}
+	}
 
-		if dp.ds != nil {
-			t.workerChs[dp.ds.Id%int64(config.Workers)] <- dp
+	if dp.ds = t.dss.getByName(dp.Name); dp.ds == nil {
+		// DS does not exist, can we create it?
+		if dsSpec := config.findMatchingDsSpec(dp.Name); dsSpec != nil {
+			if ds, err := createDataSource(dp.Name, dsSpec); err == nil {
+				t.dss.insert(ds)
+				dp.ds = ds
+			} else {
+				log.Printf("dispatcher(): createDataSource() error: %v", err)
+				atomic.AddInt64(&t.dispatcherDrops, 1)
+				return
+			}
+		} else {
+			// No spec matches this name, the data point has nowhere to go.
+			atomic.AddInt64(&t.dispatcherDrops, 1)
+			return
 		}
 	}
+
+	t.pubsub.Publish(dp)
+
+	// Consistent-hash on the (locally-assigned) DS id, not id %
+	// config.Workers: changing config.Workers only moves the DSes
+	// that actually belong to the worker that joined or left, not
+	// every DS in the cache. This is purely a local worker-pool
+	// assignment, so the node-local id is fine here.
+	t.workerChs[t.ring.Get(dp.ds.Id)] <- dp
 }
 
 // TODO: what is the point of this one-line method?
@@ -194,50 +250,37 @@ func (t *trTransceiver) queueStat(st *trStat) {
 
 func (t *trTransceiver) requestDsCopy(id int64) *trDataSource {
 	req := &dsCopyRequest{id, make(chan *trDataSource)}
-	t.dsCopyChs[id%int64(config.Workers)] <- req
+	t.dsCopyChs[t.ring.Get(id)] <- req
 	return <-req.resp
 }
 
-func (t *trTransceiver) worker(id int64) {
+func (t *trTransceiver) worker(ctx context.Context, id int64, tk ticker.Ticker) {
 
-	t.workerWg.Add(1)
-	defer t.workerWg.Done()
+	defer tk.Stop()
 
 	var (
-		ds              *trDataSource
-		flushEverything bool
-		recent          = make(map[int64]bool)
+		ds     *trDataSource
+		recent = make(map[int64]bool)
 	)
 
-	var periodicFlushCheck = make(chan int)
-	go func() {
-		for {
-			// Sleep randomly between min and max cache durations (is this wise?)
-			i := int(config.MaxCache.Duration.Nanoseconds()-config.MinCache.Duration.Nanoseconds()) / 1000
-			time.Sleep(time.Duration(rand.Intn(i))*time.Millisecond + config.MinCache.Duration)
-			periodicFlushCheck <- 1
-		}
-	}()
-
 	log.Printf("  - worker(%d) started.", id)
 	t.startWg.Done()
 
 	for {
-		ds, flushEverything = nil, false
+		ds = nil
 
 		select {
-		case <-periodicFlushCheck:
+		case <-ctx.Done():
+			t.drainWorker(id, recent)
+			return
+		case <-tk.Chan():
 			// Nothing to do here
-		case dp, ok := <-t.workerChs[id]:
-			if ok {
-				ds = dp.ds // at this point dp.ds has to be already set
-				if err := dp.process(); err == nil {
-					recent[ds.Id] = true
-				} else {
-					log.Printf("worker(%d): dp.process() error: %v", id, err)
-				}
+		case dp := <-t.workerChs[id]:
+			ds = dp.ds // at this point dp.ds has to be already set
+			if err := dp.process(); err == nil {
+				recent[ds.Id] = true
 			} else {
-				flushEverything = true
+				log.Printf("worker(%d): dp.process() error: %v", id, err)
 			}
 		case r := <-t.dsCopyChs[id]:
 			ds = t.dss.getById(r.dsId)
@@ -251,13 +294,13 @@ func (t *trTransceiver) worker(id int64) {
 		}
 
 		if ds == nil {
-			// flushEverything or periodic
+			// periodic check, see if anything recent needs flushing
 			for dsId, _ := range recent {
 				ds = t.dss.getById(dsId)
 				if ds == nil {
 					log.Printf("worker(%d): WAT? cannot lookup ds id (%d) to flush?", id, dsId)
 					continue
-				} else if flushEverything || ds.shouldBeFlushed() {
+				} else if ds.shouldBeFlushed() {
 					t.flushDs(ds)
 					delete(recent, ds.Id)
 				}
@@ -267,23 +310,47 @@ func (t *trTransceiver) worker(id int64) {
 			t.flushDs(ds)
 			delete(recent, ds.Id)
 		}
+	}
+}
 
-		if flushEverything {
-			break
+// drainWorker runs once, when the worker's context is cancelled: it
+// flushes everything this worker has touched recently, and
+// processes (then flushes) anything still sitting in workerChs[id]
+// that the dispatcher enqueued before it stopped. By the time this
+// is called the dispatcher has already stopped sending, so a single
+// non-blocking pass is enough - there is nothing left to race with.
+func (t *trTransceiver) drainWorker(id int64, recent map[int64]bool) {
+	for {
+		select {
+		case dp := <-t.workerChs[id]:
+			if err := dp.process(); err == nil {
+				recent[dp.ds.Id] = true
+			} else {
+				log.Printf("worker(%d): dp.process() error: %v", id, err)
+			}
+		default:
+			for dsId := range recent {
+				if ds := t.dss.getById(dsId); ds != nil {
+					t.flushDs(ds)
+				}
+			}
+			return
 		}
 	}
 }
 
 func (t *trTransceiver) flushDs(ds *trDataSource) {
-	t.flusherChs[ds.Id%int64(config.Workers)] <- ds.mostlyCopy()
+	t.flusherChs[t.ring.Get(ds.Id)] <- ds.mostlyCopy()
 	ds.LastFlushRT = time.Now()
 	ds.clearRRAs()
 }
 
-func (t *trTransceiver) startWorkers() {
+func (t *trTransceiver) startWorkers(ctx context.Context) {
 
 	t.workerChs = make([]chan *trDataPoint, config.Workers)
 	t.dsCopyChs = make([]chan *dsCopyRequest, config.Workers)
+	t.workerSvcs = make([]service.Service, config.Workers)
+	t.ring = hashring.New(config.Workers, 0)
 
 	log.Printf("Starting %d workers...", config.Workers)
 	t.startWg.Add(config.Workers)
@@ -291,79 +358,172 @@ func (t *trTransceiver) startWorkers() {
 		t.workerChs[i] = make(chan *trDataPoint, 1024)
 		t.dsCopyChs[i] = make(chan *dsCopyRequest, 1024)
 
-		go t.worker(int64(i))
+		id := int64(i)
+		tk := ticker.NewRandomizedTicker(config.MinCache.Duration, config.MaxCache.Duration)
+		svc := service.NewBaseService(fmt.Sprintf("worker(%d)", id), func(ctx context.Context) { t.worker(ctx, id, tk) })
+		t.workerSvcs[i] = svc
+		svc.Start(ctx)
 	}
 
 }
 
-func (t *trTransceiver) flusher(id int64) {
-	t.flusherWg.Add(1)
-	defer t.flusherWg.Done()
+func (t *trTransceiver) flusher(ctx context.Context, id int64) {
 
 	log.Printf("  - flusher(%d) started.", id)
 	t.startWg.Done()
 
 	for {
-		ds, ok := <-t.flusherChs[id]
-		if ok {
-			if err := flushDataSource(ds); err != nil {
-				log.Printf("flusher(%d): error flushing data source %v: %v", id, ds, err)
-			}
-		} else {
-			log.Printf("flusher(%d): channel closed, exiting", id)
-			break
+		select {
+		case <-ctx.Done():
+			t.drainFlusher(id)
+			return
+		case ds := <-t.flusherChs[id]:
+			t.doFlush(id, ds)
 		}
 	}
 
 }
 
-func (t *trTransceiver) startFlushers() {
+// drainFlusher runs once, when the flusher's context is cancelled:
+// workers have already stopped by this point, so a single
+// non-blocking pass over flusherChs[id] is enough to flush whatever
+// was still in flight.
+func (t *trTransceiver) drainFlusher(id int64) {
+	for {
+		select {
+		case ds := <-t.flusherChs[id]:
+			t.doFlush(id, ds)
+		default:
+			log.Printf("flusher(%d): drained, exiting", id)
+			return
+		}
+	}
+}
+
+func (t *trTransceiver) doFlush(id int64, ds *trDataSource) {
+	start := time.Now()
+	if err := flushDataSource(ds); err != nil {
+		log.Printf("flusher(%d): error flushing data source %v: %v", id, ds, err)
+	}
+	atomic.StoreInt64(&t.flusherLatency[id], time.Since(start).Nanoseconds())
+}
+
+func (t *trTransceiver) startFlushers(ctx context.Context) {
 
 	t.flusherChs = make([]chan *trDataSource, config.Workers)
+	t.flusherLatency = make([]int64, config.Workers)
+	t.flusherSvcs = make([]service.Service, config.Workers)
 
 	log.Printf("Starting %d flushers...", config.Workers)
 	t.startWg.Add(config.Workers)
 	for i := 0; i < config.Workers; i++ {
 		t.flusherChs[i] = make(chan *trDataSource)
-		go t.flusher(int64(i))
+
+		id := int64(i)
+		svc := service.NewBaseService(fmt.Sprintf("flusher(%d)", id), func(ctx context.Context) { t.flusher(ctx, id) })
+		t.flusherSvcs[i] = svc
+		svc.Start(ctx)
 	}
 }
 
-func (t *trTransceiver) startStatWorker() {
+func (t *trTransceiver) startStatWorker(ctx context.Context) {
 	t.stCh = make(chan *trStat, 1024)
 	log.Printf("Starting statWorker...")
 	t.startWg.Add(1)
-	go t.statWorker()
+	tk := ticker.NewAlignedTicker(config.StatFlush.Duration)
+	t.statSvc = service.NewBaseService("statWorker", func(ctx context.Context) { t.statWorker(ctx, tk) })
+	t.statSvc.Start(ctx)
 }
 
-func (t *trTransceiver) statWorker() {
-
-	t.statWg.Add(1)
-	defer t.statWg.Done()
-
-	var flushCh = make(chan int, 1)
-	go func() {
-		for {
-			// NB: We do not use a time.Ticker here because my simple
-			// experiments show that it will not stay aligned on a
-			// multiple of durationif the system clock is
-			// adjusted. This thing will mostly remain aligned.
-			clock := time.Now()
-			time.Sleep(clock.Truncate(config.StatFlush.Duration).Add(config.StatFlush.Duration).Sub(clock))
-			if len(flushCh) == 0 {
-				flushCh <- 1
-			} else {
-				log.Printf("statWorker(): dropping stat flush timer on the floor - busy system?")
-			}
+// timerStats accumulates the StatsD "ms" observations for a single
+// timer name between flushes. Samples are fed into a streaming
+// quantile sketch (github.com/beorn7/perks/quantile, an
+// implementation of the CKMS algorithm) rather than an
+// ever-growing []float64, so memory stays bounded regardless of how
+// many samples arrive between flushes. count/sum/mean/min/max are
+// tracked with a running total and std is computed with Welford's
+// online variance so a full second pass over the samples is never
+// needed. min/max are tracked exactly rather than read off the
+// sketch: a targeted sketch only bounds error at its registered
+// quantiles, and 0/1 are not guaranteed to be among them. median has
+// the same problem at 0.5, but is cheaper to fix by just always
+// registering 0.5 as a target - newTimerStats does that, so .median
+// is a bounded-error sketch query like any other percentile, not an
+// exact value.
+type timerStats struct {
+	sketch *quantile.Stream
+	count  int64
+	sum    float64
+	mean   float64
+	m2     float64 // Welford's running sum of squares of differences from the mean
+	min    float64
+	max    float64
+}
+
+func newTimerStats() *timerStats {
+	targets := make(map[float64]float64, len(config.Percentiles)+1)
+	targets[0.5] = 0.001 // always register the median so .median is bounded-error regardless of config.Percentiles
+	for _, p := range config.Percentiles {
+		targets[float64(p)/100] = 0.001
+	}
+	return &timerStats{sketch: quantile.NewTargeted(targets)}
+}
+
+func (ts *timerStats) insert(v float64) {
+	ts.sketch.Insert(v)
+	if ts.count == 0 || v < ts.min {
+		ts.min = v
+	}
+	if ts.count == 0 || v > ts.max {
+		ts.max = v
+	}
+	ts.count++
+	delta := v - ts.mean
+	ts.mean += delta / float64(ts.count)
+	ts.m2 += delta * (v - ts.mean)
+	ts.sum += v
+}
+
+func (ts *timerStats) std() float64 {
+	if ts.count < 2 {
+		return 0
+	}
+	// Population, not sample, variance: the StatsD reference
+	// implementation divides by count, and .std needs to match it
+	// for this to be comparable to any other StatsD-compatible sink.
+	return math.Sqrt(ts.m2 / float64(ts.count))
+}
+
+// sumMeanBelow approximates the sum and mean of the samples at or
+// below value using the sketch's retained (compressed) summary
+// samples, since the sketch does not keep the raw observations
+// needed for an exact trimmed sum. This is how upper_N's
+// counterparts sum_N/mean_N are derived.
+func (ts *timerStats) sumMeanBelow(value float64) (sum float64, mean float64) {
+	var n float64
+	for _, s := range ts.sketch.Samples() {
+		if s.Value > value {
+			break
 		}
-	}()
+		n += s.Width
+		sum += s.Value * s.Width
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return sum, sum / n
+}
+
+func (t *trTransceiver) statWorker(ctx context.Context, tk ticker.Ticker) {
+
+	defer tk.Stop()
 
 	log.Printf("  - statWorker() started.")
 	t.startWg.Done()
 
 	counts := make(map[string]int64)
 	gauges := make(map[string]float64)
-	timers := make(map[string][]float64)
+	timers := make(map[string]*timerStats)
 
 	prefix := config.StatsNamePrefix
 
@@ -375,76 +535,82 @@ func (t *trTransceiver) statWorker() {
 		for name, gauge := range gauges {
 			t.queueDataPoint(&trDataPoint{Name: prefix + ".gauges." + name, TimeStamp: time.Now(), Value: gauge})
 		}
-		for name, times := range timers {
-			// count
-			t.queueDataPoint(&trDataPoint{Name: prefix + ".timers." + name + ".count", TimeStamp: time.Now(), Value: float64(len(times))})
-
-			// lower, upper, sum, mean
-			if len(times) > 0 {
-				var (
-					lower, upper = times[0], times[0]
-					sum          float64
-				)
-
-				for _, v := range times[1:] {
-					lower = math.Min(lower, v)
-					upper = math.Max(upper, v)
-					sum += v
+		for name, ts := range timers {
+			base := prefix + ".timers." + name
+
+			t.queueDataPoint(&trDataPoint{Name: base + ".count", TimeStamp: time.Now(), Value: float64(ts.count)})
+			t.queueDataPoint(&trDataPoint{Name: base + ".count_ps", TimeStamp: time.Now(), Value: float64(ts.count) / config.StatFlush.Duration.Seconds()})
+
+			if ts.count > 0 {
+				t.queueDataPoint(&trDataPoint{Name: base + ".lower", TimeStamp: time.Now(), Value: ts.min})
+				t.queueDataPoint(&trDataPoint{Name: base + ".upper", TimeStamp: time.Now(), Value: ts.max})
+				t.queueDataPoint(&trDataPoint{Name: base + ".sum", TimeStamp: time.Now(), Value: ts.sum})
+				t.queueDataPoint(&trDataPoint{Name: base + ".mean", TimeStamp: time.Now(), Value: ts.mean})
+				t.queueDataPoint(&trDataPoint{Name: base + ".median", TimeStamp: time.Now(), Value: ts.sketch.Query(0.5)})
+				t.queueDataPoint(&trDataPoint{Name: base + ".std", TimeStamp: time.Now(), Value: ts.std()})
+
+				for _, p := range config.Percentiles {
+					suffix := fmt.Sprintf("_%d", p)
+					upperP := ts.sketch.Query(float64(p) / 100)
+					sumP, meanP := ts.sumMeanBelow(upperP)
+					t.queueDataPoint(&trDataPoint{Name: base + ".upper" + suffix, TimeStamp: time.Now(), Value: upperP})
+					t.queueDataPoint(&trDataPoint{Name: base + ".sum" + suffix, TimeStamp: time.Now(), Value: sumP})
+					t.queueDataPoint(&trDataPoint{Name: base + ".mean" + suffix, TimeStamp: time.Now(), Value: meanP})
 				}
-				t.queueDataPoint(&trDataPoint{Name: prefix + ".timers." + name + ".lower", TimeStamp: time.Now(), Value: lower})
-				t.queueDataPoint(&trDataPoint{Name: prefix + ".timers." + name + ".upper", TimeStamp: time.Now(), Value: upper})
-				t.queueDataPoint(&trDataPoint{Name: prefix + ".timers." + name + ".sum", TimeStamp: time.Now(), Value: sum})
-				t.queueDataPoint(&trDataPoint{Name: prefix + ".timers." + name + ".mean", TimeStamp: time.Now(), Value: sum / float64(len(times))})
 			}
-
-			// TODO - these will require sorting:
-			// count_ps ?
-			// mean_90
-			// median
-			// std
-			// sum_90
-			// upper_90
-
 		}
 		// clear the maps
 		counts = make(map[string]int64)
 		gauges = make(map[string]float64)
-		timers = make(map[string][]float64)
+		timers = make(map[string]*timerStats)
+	}
+
+	var applyStat = func(st *trStat) {
+		if st.metric == "c" {
+			if _, ok := counts[st.name]; !ok {
+				counts[st.name] = 0
+			}
+			counts[st.name] += int64(st.value)
+		} else if st.metric == "g" {
+			gauges[st.name] = st.value
+		} else if st.metric == "ms" {
+			if _, ok := timers[st.name]; !ok {
+				timers[st.name] = newTimerStats()
+			}
+			timers[st.name].insert(st.value)
+		} else {
+			log.Printf("statWorker(): invalid metric type: %q, ignoring.", st.metric)
+		}
 	}
 
 	for {
 		// It's important to flush stats at as precise time as
 		// possible. This non-blocking select will guarantee that we
-		// process flushCh even if there is stuff in the stCh.
+		// process a pending tick even if there is stuff in the stCh.
 		select {
-		case <-flushCh:
+		case <-tk.Chan():
 			flushStats()
 		default:
 		}
 
 		select {
-		case <-flushCh:
-			flushStats()
-		case st, ok := <-t.stCh:
-			if !ok {
-				flushStats() // Final flush
-				return
-			}
-			if st.metric == "c" {
-				if _, ok := counts[st.name]; !ok {
-					counts[st.name] = 0
-				}
-				counts[st.name] += int64(st.value)
-			} else if st.metric == "g" {
-				gauges[st.name] = st.value
-			} else if st.metric == "ms" {
-				if _, ok := timers[st.name]; !ok {
-					timers[st.name] = make([]float64, 4)
+		case <-ctx.Done():
+			// Drain whatever is already buffered in stCh before the
+			// final flush - otherwise stats queued just before
+			// shutdown are silently lost instead of reported.
+			for {
+				select {
+				case st := <-t.stCh:
+					applyStat(st)
+				default:
+					flushStats() // Final flush
+					return
 				}
-				timers[st.name] = append(timers[st.name], st.value)
-			} else {
-				log.Printf("statWorker(): invalid metric type: %q, ignoring.", st.metric)
 			}
+		case <-tk.Chan():
+			flushStats()
+		case st := <-t.stCh:
+			applyStat(st)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,50 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timeriver
+
+import (
+	"math"
+	"testing"
+)
+
+// TestTimerStatsStdIsPopulationVariance pins std() to the StatsD
+// reference behavior (divide by count, not count-1), using a sample
+// whose population standard deviation is easy to compute by hand.
+func TestTimerStatsStdIsPopulationVariance(t *testing.T) {
+	ts := newTimerStats()
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		ts.insert(v)
+	}
+
+	// mean = 5, population variance = 32/8 = 4, population std = 2.
+	want := 2.0
+	if got := ts.std(); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("std() = %v, want %v", got, want)
+	}
+}
+
+func TestTimerStatsTracksExactMinMax(t *testing.T) {
+	ts := newTimerStats()
+	for _, v := range []float64{5, 1, 9, 3, 7} {
+		ts.insert(v)
+	}
+	if ts.min != 1 {
+		t.Fatalf("min = %v, want 1", ts.min)
+	}
+	if ts.max != 9 {
+		t.Fatalf("max = %v, want 9", ts.max)
+	}
+}